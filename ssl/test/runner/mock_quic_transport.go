@@ -22,10 +22,6 @@ import (
 	"net"
 )
 
-const tagHandshake = byte('H')
-const tagApplication = byte('A')
-const tagAlert = byte('L')
-
 type encryptionLevel byte
 
 const (
@@ -42,33 +38,184 @@ const (
 // clear.)
 //
 // Messages from TLS that are sent over a mockQUICTransport are wrapped in a
-// TLV-like format. The first byte of a mockQUICTransport message is a tag
-// indicating the TLS record type. This is followed by the 2 byte cipher suite
-// ID of the cipher suite that would have been used to encrypt the record. Next
-// is a 4-byte big-endian length indicating the length of the remaining payload.
-// The payload starts with the key that would be used to encrypt the record, and
+// TLV-like format. The first byte of a mockQUICTransport message is the
+// recordType of the TLS record it carries. The second byte is the
+// encryptionLevel of the record. This is followed by the 2 byte
+// cipher suite ID of the cipher suite that would have been used to encrypt
+// the record. Next is a 4-byte big-endian length indicating the length of the
+// remaining payload. The payload starts with the key that would be used to
+// encrypt the record, and
 // the remainder of the payload is the plaintext of the TLS record. Note that
 // the 4-byte length covers the length of the key and plaintext, but not the
 // cipher suite ID or tag.
+//
+// By default, records are written to and read from the underlying connection
+// one at a time, in order, with an immediate error if the next record's level
+// or cipher suite does not match what TLS currently expects. Setting
+// wireImage switches to a second mode that models the QUIC wire image more
+// closely: writeRecord accumulates records into the datagram under
+// construction rather than writing them out immediately, flushFlight seals
+// that datagram and queues it, and releaseDatagrams hands the queued
+// datagrams to the connection in a possibly scripted order. This lets tests
+// exercise coalesced CRYPTO frames across encryption levels, dropped or
+// reordered datagrams (e.g. dropping the first ClientHello to force a
+// HelloRetryRequest or retransmit), and, with allowOutOfOrderLevels, records
+// that arrive at a level before the peer has installed the keys for it.
 type mockQUICTransport struct {
 	net.Conn
 	readLevel, writeLevel             encryptionLevel
 	readSecret, writeSecret           []byte
 	readCipherSuite, writeCipherSuite uint16
 	skipEarlyData                     bool
+
+	// earlyDataWriteSecret and earlyDataCipherSuite are the secret and cipher
+	// suite used for records written at encryptionEarlyData via
+	// writeRecordAtLevel. Unlike writeSecret/writeCipherSuite, they are kept
+	// independently of writeLevel, since a resumed client writes early data
+	// before it has installed Handshake keys, i.e. before writeLevel advances
+	// past encryptionEarlyData.
+	earlyDataWriteSecret []byte
+	earlyDataCipherSuite uint16
+
+	// wireImage enables the datagram-oriented emulation mode described above.
+	// It is false by default, preserving the original strict, one-record-at-
+	// a-time behavior for existing tests.
+	wireImage bool
+
+	// allowOutOfOrderLevels, when wireImage is set, makes readDatagram buffer
+	// records that arrive at a level other than readLevel instead of
+	// treating them as an error, so that a shim's buffering of out-of-order
+	// encryption levels can be tested.
+	allowOutOfOrderLevels bool
+
+	// dropDatagrams names the 0-indexed datagrams, in the order flushFlight
+	// produced them, that should be silently discarded by flushFlight rather
+	// than queued for delivery.
+	dropDatagrams map[int]bool
+
+	// writeDatagram accumulates the records written for the datagram
+	// currently under construction. It is sealed and queued by flushFlight.
+	writeDatagram []byte
+
+	// queuedDatagrams holds datagrams sealed by flushFlight, in the order
+	// they were sealed, awaiting release to the connection by
+	// releaseDatagrams.
+	queuedDatagrams [][]byte
+
+	// datagramsWritten counts the datagrams passed to flushFlight, including
+	// ones dropDatagrams discarded, so dropDatagrams can be keyed by index.
+	datagramsWritten int
+
+	// pendingRecords holds the records readDatagram parsed out of datagrams,
+	// keyed by level, until readWireImage returns them once readLevel
+	// matches their level.
+	pendingRecords map[encryptionLevel][]pendingRecord
+
+	// keyChangeCallback, if set, is invoked by setReadKeys and setWriteKeys
+	// whenever the read or write secret changes, so a test can independently
+	// verify the installed secrets against the TLS 1.3 key schedule. See
+	// QUICKeyChangeCallback.
+	keyChangeCallback QUICKeyChangeCallback
 }
 
-func newMockQUICTransport(conn net.Conn) *mockQUICTransport {
-	return &mockQUICTransport{Conn: conn}
+// QUICKeyChangeCallback is invoked whenever mockQUICTransport installs a new
+// read or write secret for an encryption level. readSecret and writeSecret
+// are the transport's current secrets for their respective directions, which
+// may be for different levels if the two directions' keys were not installed
+// at the same time. Tests use this to cross-check the secrets the library
+// installed against ones independently re-derived from the handshake
+// transcript; see deriveQUICKeySchedule.
+type QUICKeyChangeCallback func(level encryptionLevel, readSecret, writeSecret []byte, suite uint16)
+
+// setReadKeys installs the read secret and cipher suite for level, advancing
+// readLevel, and invokes keyChangeCallback if set.
+func (m *mockQUICTransport) setReadKeys(level encryptionLevel, secret []byte, suite uint16) {
+	m.readLevel = level
+	m.readSecret = secret
+	m.readCipherSuite = suite
+	if m.keyChangeCallback != nil {
+		m.keyChangeCallback(level, m.readSecret, m.writeSecret, suite)
+	}
 }
 
-func (m *mockQUICTransport) read() (byte, []byte, error) {
+// setWriteKeys installs the write secret and cipher suite for level,
+// advancing writeLevel, and invokes keyChangeCallback if set.
+func (m *mockQUICTransport) setWriteKeys(level encryptionLevel, secret []byte, suite uint16) {
+	m.writeLevel = level
+	m.writeSecret = secret
+	m.writeCipherSuite = suite
+	if m.keyChangeCallback != nil {
+		m.keyChangeCallback(level, m.readSecret, m.writeSecret, suite)
+	}
+}
+
+// pendingRecord is a record buffered by readDatagram until readWireImage
+// returns it at its encryption level. The cipher suite and secret are
+// validated lazily, once readLevel reaches the level the record was queued
+// under, since the expected secret for a not-yet-current level may not be
+// known until then.
+type pendingRecord struct {
+	typ         recordType
+	cipherSuite uint16
+	value       []byte // the secret prefix followed by the record plaintext
+}
+
+// mockQUICTransportParams configures the aspects of mockQUICTransport that
+// the runner's Config/test_case machinery is expected to set per test case:
+// which emulation mode to use, and the knobs that mode exposes. The zero
+// value reproduces the original strict, single-record-at-a-time behavior.
+type mockQUICTransportParams struct {
+	// wireImage, allowOutOfOrderLevels, and dropDatagrams configure the
+	// QUIC-wire-image emulation mode; see the mockQUICTransport doc comment.
+	wireImage             bool
+	allowOutOfOrderLevels bool
+	dropDatagrams         map[int]bool
+
+	// earlyDataCipherSuite and earlyDataWriteSecret seed the independent
+	// early-data write keys used by writeRecordAtLevel; see the field
+	// comment on mockQUICTransport.
+	earlyDataCipherSuite uint16
+	earlyDataWriteSecret []byte
+
+	// keyChangeCallback, if set, is Config.QUICKeyChangeCallback: a hook a
+	// test installs to independently verify the secrets this transport
+	// installs via setReadKeys/setWriteKeys. This checkout has no common.go
+	// defining Config, so the field lives here; in the full tree, whatever
+	// constructs a mockQUICTransport should thread Config's field through to
+	// this one.
+	keyChangeCallback QUICKeyChangeCallback
+}
+
+func newMockQUICTransport(conn net.Conn, params mockQUICTransportParams) *mockQUICTransport {
+	m := &mockQUICTransport{
+		Conn:                  conn,
+		wireImage:             params.wireImage,
+		allowOutOfOrderLevels: params.allowOutOfOrderLevels,
+		dropDatagrams:         params.dropDatagrams,
+		earlyDataCipherSuite:  params.earlyDataCipherSuite,
+		earlyDataWriteSecret:  params.earlyDataWriteSecret,
+		keyChangeCallback:     params.keyChangeCallback,
+	}
+	// Install the initial (Initial-level, empty-secret) keys through the
+	// same setReadKeys/setWriteKeys path a real handshake driver uses to
+	// advance levels, rather than setting readLevel/writeLevel etc.
+	// directly, so keyChangeCallback reliably observes every key the
+	// connection ever has, including the first.
+	m.setReadKeys(encryptionInitial, nil, 0)
+	m.setWriteKeys(encryptionInitial, nil, 0)
+	return m
+}
+
+func (m *mockQUICTransport) read() (recordType, []byte, error) {
+	if m.wireImage {
+		return m.readWireImage()
+	}
 	for {
 		header := make([]byte, 8)
 		if _, err := io.ReadFull(m.Conn, header); err != nil {
 			return 0, nil, err
 		}
-		tag := header[0]
+		tag := recordType(header[0])
 		level := header[1]
 		cipherSuite := binary.BigEndian.Uint16(header[2:4])
 		length := binary.BigEndian.Uint32(header[4:])
@@ -82,16 +229,9 @@ func (m *mockQUICTransport) read() (byte, []byte, error) {
 			}
 			return 0, nil, fmt.Errorf("received level %d does not match expected %d", level, m.readLevel)
 		}
-		if cipherSuite != m.readCipherSuite {
-			return 0, nil, fmt.Errorf("received cipher suite %d does not match expected %d", cipherSuite, m.readCipherSuite)
-		}
-		if len(m.readSecret) > len(value) {
-			return 0, nil, fmt.Errorf("input length too short")
-		}
-		secret := value[:len(m.readSecret)]
-		out := value[len(m.readSecret):]
-		if !bytes.Equal(secret, m.readSecret) {
-			return 0, nil, fmt.Errorf("secrets don't match: got %x but expected %x", secret, m.readSecret)
+		out, err := m.checkSecret(cipherSuite, value)
+		if err != nil {
+			return 0, nil, err
 		}
 		// Although not true for QUIC in general, our transport is ordered, so
 		// we expect to stop skipping early data after a valid record.
@@ -100,40 +240,201 @@ func (m *mockQUICTransport) read() (byte, []byte, error) {
 	}
 }
 
+// checkSecret validates that value is prefixed with the secret currently
+// expected for cipherSuite at readLevel and, if so, returns the remainder of
+// value: the plaintext of the record.
+func (m *mockQUICTransport) checkSecret(cipherSuite uint16, value []byte) ([]byte, error) {
+	if cipherSuite != m.readCipherSuite {
+		return nil, fmt.Errorf("received cipher suite %d does not match expected %d", cipherSuite, m.readCipherSuite)
+	}
+	if len(m.readSecret) > len(value) {
+		return nil, fmt.Errorf("input length too short")
+	}
+	secret := value[:len(m.readSecret)]
+	out := value[len(m.readSecret):]
+	if !bytes.Equal(secret, m.readSecret) {
+		return nil, fmt.Errorf("secrets don't match: got %x but expected %x", secret, m.readSecret)
+	}
+	return out, nil
+}
+
+// readWireImage implements read when wireImage is set. It first drains any
+// record buffered at readLevel by a previous call to readDatagram, then reads
+// datagrams off the wire until one yields such a record.
+func (m *mockQUICTransport) readWireImage() (recordType, []byte, error) {
+	for {
+		if pending := m.pendingRecords[m.readLevel]; len(pending) > 0 {
+			m.pendingRecords[m.readLevel] = pending[1:]
+			out, err := m.checkSecret(pending[0].cipherSuite, pending[0].value)
+			if err != nil {
+				return 0, nil, err
+			}
+			return pending[0].typ, out, nil
+		}
+		if err := m.readDatagram(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// readDatagram reads one length-prefixed datagram off the wire, as queued by
+// flushFlight/releaseDatagrams, and parses out the records coalesced within
+// it. A record at readLevel is buffered in pendingRecords just like any
+// other; readWireImage is what drains pendingRecords[readLevel].
+func (m *mockQUICTransport) readDatagram() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(m.Conn, header); err != nil {
+		return err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(m.Conn, datagram); err != nil {
+		return fmt.Errorf("error reading datagram")
+	}
+	if m.pendingRecords == nil {
+		m.pendingRecords = make(map[encryptionLevel][]pendingRecord)
+	}
+	for len(datagram) > 0 {
+		if len(datagram) < 8 {
+			return fmt.Errorf("truncated record header in datagram")
+		}
+		typ := recordType(datagram[0])
+		level := encryptionLevel(datagram[1])
+		cipherSuite := binary.BigEndian.Uint16(datagram[2:4])
+		length := binary.BigEndian.Uint32(datagram[4:8])
+		datagram = datagram[8:]
+		if uint64(len(datagram)) < uint64(length) {
+			return fmt.Errorf("truncated record payload in datagram")
+		}
+		value := datagram[:length]
+		datagram = datagram[length:]
+
+		if level != m.readLevel {
+			if m.skipEarlyData && level == encryptionEarlyData {
+				continue
+			}
+			if !m.allowOutOfOrderLevels {
+				return fmt.Errorf("received level %d does not match expected %d", level, m.readLevel)
+			}
+		} else {
+			// As in the strict-mode path in read, our transport is ordered,
+			// so we expect to stop skipping early data after a record at the
+			// expected level.
+			m.skipEarlyData = false
+		}
+		m.pendingRecords[level] = append(m.pendingRecords[level], pendingRecord{typ, cipherSuite, value})
+	}
+	return nil
+}
+
+// flushFlight seals the records written since the last flushFlight into a
+// single datagram, modeling the coalescing of same-flight CRYPTO frames into
+// one QUIC datagram, and queues it for release. dropDatagrams may cause it to
+// be discarded instead. It has no effect if wireImage is unset or nothing has
+// been written since the last flush.
+func (m *mockQUICTransport) flushFlight() error {
+	if !m.wireImage || len(m.writeDatagram) == 0 {
+		return nil
+	}
+	seq := m.datagramsWritten
+	m.datagramsWritten++
+	datagram := m.writeDatagram
+	m.writeDatagram = nil
+	if m.dropDatagrams[seq] {
+		return nil
+	}
+	m.queuedDatagrams = append(m.queuedDatagrams, datagram)
+	return nil
+}
+
+// releaseDatagrams writes the datagrams queued by flushFlight to the
+// underlying connection in the order named by order, a permutation of
+// [0, len(queuedDatagrams)), allowing tests to script reordering. A nil order
+// releases the datagrams in the order they were queued.
+func (m *mockQUICTransport) releaseDatagrams(order []int) error {
+	if order == nil {
+		order = make([]int, len(m.queuedDatagrams))
+		for i := range order {
+			order[i] = i
+		}
+	}
+	for _, i := range order {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(m.queuedDatagrams[i])))
+		if _, err := m.Conn.Write(header); err != nil {
+			return err
+		}
+		if _, err := m.Conn.Write(m.queuedDatagrams[i]); err != nil {
+			return err
+		}
+	}
+	m.queuedDatagrams = nil
+	return nil
+}
+
 func (m *mockQUICTransport) readRecord(want recordType) (recordType, *block, error) {
 	typ, contents, err := m.read()
 	if err != nil {
 		return 0, nil, err
 	}
-	var returnType recordType
-	if typ == tagHandshake {
-		returnType = recordTypeHandshake
-	} else if typ == tagApplication {
-		returnType = recordTypeApplicationData
-	} else if typ == tagAlert {
-		returnType = recordTypeAlert
-	} else {
+	switch typ {
+	case recordTypeHandshake, recordTypeApplicationData, recordTypeAlert:
+	default:
 		return 0, nil, fmt.Errorf("unknown type %d\n", typ)
 	}
-	return returnType, &block{contents, 0, nil}, nil
+	return typ, &block{contents, 0, nil}, nil
 }
 
 func (m *mockQUICTransport) writeRecord(typ recordType, data []byte) (int, error) {
-	tag := tagHandshake
-	if typ == recordTypeApplicationData {
-		tag = tagApplication
-	} else if typ != recordTypeHandshake {
+	return m.writeRecordRaw(m.writeLevel, typ, m.writeCipherSuite, m.writeSecret, data)
+}
+
+// writeRecordAtLevel writes a record at level rather than writeLevel, using
+// the secret and cipher suite appropriate for that level: earlyDataCipherSuite
+// and earlyDataWriteSecret for encryptionEarlyData, or writeCipherSuite and
+// writeSecret otherwise. It lets a test emit, for example, 0-RTT application
+// data and a Handshake-level flight within the same flushFlight-sealed
+// datagram, without disturbing writeLevel/writeSecret in between.
+func (m *mockQUICTransport) writeRecordAtLevel(level encryptionLevel, typ recordType, data []byte) (int, error) {
+	cipherSuite := m.writeCipherSuite
+	secret := m.writeSecret
+	if level == encryptionEarlyData {
+		cipherSuite = m.earlyDataCipherSuite
+		secret = m.earlyDataWriteSecret
+	}
+	return m.writeRecordRaw(level, typ, cipherSuite, secret, data)
+}
+
+// writeRecordWithSecret behaves like writeRecord, but prefixes the record
+// with secret rather than writeSecret. This lets a test inject a record
+// encrypted under the wrong secret, to confirm the peer rejects it.
+func (m *mockQUICTransport) writeRecordWithSecret(typ recordType, secret, data []byte) (int, error) {
+	return m.writeRecordRaw(m.writeLevel, typ, m.writeCipherSuite, secret, data)
+}
+
+// writeRecordRaw serializes and writes a single record with the given level,
+// cipher suite, and secret: into the datagram under construction if
+// wireImage is set, or directly to the connection otherwise. writeRecord,
+// writeRecordAtLevel, and writeRecordWithSecret are all thin wrappers around
+// this, differing only in which level/cipherSuite/secret they pass.
+func (m *mockQUICTransport) writeRecordRaw(level encryptionLevel, typ recordType, cipherSuite uint16, secret, data []byte) (int, error) {
+	switch typ {
+	case recordTypeHandshake, recordTypeApplicationData, recordTypeAlert:
+	default:
 		return 0, fmt.Errorf("unsupported record type %d\n", typ)
 	}
-	length := len(m.writeSecret) + len(data)
-	payload := make([]byte, 1+1+2+4+length)
-	payload[0] = tag
-	payload[1] = byte(m.writeLevel)
-	binary.BigEndian.PutUint16(payload[2:4], m.writeCipherSuite)
-	binary.BigEndian.PutUint32(payload[4:8], uint32(length))
-	copy(payload[8:], m.writeSecret)
-	copy(payload[8+len(m.writeSecret):], data)
-	if _, err := m.Conn.Write(payload); err != nil {
+	length := len(secret) + len(data)
+	record := make([]byte, 1+1+2+4+length)
+	record[0] = byte(typ)
+	record[1] = byte(level)
+	binary.BigEndian.PutUint16(record[2:4], cipherSuite)
+	binary.BigEndian.PutUint32(record[4:8], uint32(length))
+	copy(record[8:], secret)
+	copy(record[8+len(secret):], data)
+	if m.wireImage {
+		m.writeDatagram = append(m.writeDatagram, record...)
+		return len(data), nil
+	}
+	if _, err := m.Conn.Write(record); err != nil {
 		return 0, err
 	}
 	return len(data), nil
@@ -0,0 +1,280 @@
+// Copyright (c) 2019, Google Inc.
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION
+// OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF OR IN
+// CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package runner
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConn is a net.Conn backed by a shared, unsynchronized bytes.Buffer. It
+// is only safe to write a test's whole input before reading any of it, which
+// is all these tests need: mockQUICTransport otherwise has no notion of a
+// connection's address or deadlines.
+type testConn struct {
+	*bytes.Buffer
+}
+
+func (testConn) Close() error                       { return nil }
+func (testConn) LocalAddr() net.Addr                { return nil }
+func (testConn) RemoteAddr() net.Addr               { return nil }
+func (testConn) SetDeadline(t time.Time) error      { return nil }
+func (testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestMockQUICTransportKeyChangeCallback(t *testing.T) {
+	type call struct {
+		level                   encryptionLevel
+		readSecret, writeSecret []byte
+		suite                   uint16
+	}
+	var calls []call
+	conn := testConn{new(bytes.Buffer)}
+	m := newMockQUICTransport(conn, mockQUICTransportParams{
+		keyChangeCallback: func(level encryptionLevel, readSecret, writeSecret []byte, suite uint16) {
+			calls = append(calls, call{level, append([]byte(nil), readSecret...), append([]byte(nil), writeSecret...), suite})
+		},
+	})
+	// newMockQUICTransport itself installs the initial Initial-level keys
+	// through setReadKeys/setWriteKeys, so the callback should already have
+	// fired twice (once per direction) before any handshake progress.
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls after construction, want 2", len(calls))
+	}
+
+	m.setReadKeys(encryptionHandshake, []byte("handshake read secret"), 0x1301)
+	if len(calls) != 3 {
+		t.Fatalf("got %d calls after setReadKeys, want 3", len(calls))
+	}
+	last := calls[len(calls)-1]
+	if last.level != encryptionHandshake || string(last.readSecret) != "handshake read secret" || last.suite != 0x1301 {
+		t.Errorf("got %+v, want the Handshake read secret just installed", last)
+	}
+
+	m.setWriteKeys(encryptionApplication, []byte("application write secret"), 0x1302)
+	if len(calls) != 4 {
+		t.Fatalf("got %d calls after setWriteKeys, want 4", len(calls))
+	}
+	last = calls[len(calls)-1]
+	if last.level != encryptionApplication || string(last.writeSecret) != "application write secret" || last.suite != 0x1302 {
+		t.Errorf("got %+v, want the Application write secret just installed", last)
+	}
+	// The callback reports both directions' current secrets together, so the
+	// read secret installed earlier should still be visible here.
+	if string(last.readSecret) != "handshake read secret" {
+		t.Errorf("got read secret %q, want it to still reflect the earlier setReadKeys call", last.readSecret)
+	}
+}
+
+func TestMockQUICTransportAlert(t *testing.T) {
+	conn := testConn{new(bytes.Buffer)}
+	w := newMockQUICTransport(conn, mockQUICTransportParams{})
+	if _, err := w.writeRecord(recordTypeAlert, []byte{1, 2}); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+
+	r := newMockQUICTransport(conn, mockQUICTransportParams{})
+	typ, block, err := r.readRecord(recordTypeAlert)
+	if err != nil {
+		t.Fatalf("readRecord: %v", err)
+	}
+	if typ != recordTypeAlert {
+		t.Errorf("got record type %d, want recordTypeAlert", typ)
+	}
+	if !bytes.Equal(block.data, []byte{1, 2}) {
+		t.Errorf("got data %x, want 0102", block.data)
+	}
+}
+
+func TestMockQUICTransportWireImageDropDatagram(t *testing.T) {
+	conn := testConn{new(bytes.Buffer)}
+	w := newMockQUICTransport(conn, mockQUICTransportParams{
+		wireImage:     true,
+		dropDatagrams: map[int]bool{0: true},
+	})
+	if _, err := w.writeRecord(recordTypeHandshake, []byte("dropped")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+	if _, err := w.writeRecord(recordTypeHandshake, []byte("kept")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+	if err := w.releaseDatagrams(nil); err != nil {
+		t.Fatalf("releaseDatagrams: %v", err)
+	}
+
+	r := newMockQUICTransport(conn, mockQUICTransportParams{wireImage: true})
+	_, block, err := r.readRecord(recordTypeHandshake)
+	if err != nil {
+		t.Fatalf("readRecord: %v", err)
+	}
+	if string(block.data) != "kept" {
+		t.Errorf("got %q, want the second flight; the dropped datagram should not have been delivered", block.data)
+	}
+}
+
+func TestMockQUICTransportOutOfOrderLevels(t *testing.T) {
+	conn := testConn{new(bytes.Buffer)}
+	w := newMockQUICTransport(conn, mockQUICTransportParams{wireImage: true})
+	w.writeLevel = encryptionHandshake
+	if _, err := w.writeRecord(recordTypeHandshake, []byte("handshake data")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+	if err := w.releaseDatagrams(nil); err != nil {
+		t.Fatalf("releaseDatagrams: %v", err)
+	}
+
+	r := newMockQUICTransport(conn, mockQUICTransportParams{
+		wireImage:             true,
+		allowOutOfOrderLevels: true,
+	})
+	// The reader is still expecting Initial; the Handshake-level record
+	// should be buffered rather than rejected.
+	if err := r.readDatagram(); err != nil {
+		t.Fatalf("readDatagram: %v", err)
+	}
+	if len(r.pendingRecords[encryptionHandshake]) != 1 {
+		t.Fatalf("got %d pending Handshake records, want 1", len(r.pendingRecords[encryptionHandshake]))
+	}
+
+	// Advancing readLevel should let read return the buffered record.
+	r.readLevel = encryptionHandshake
+	r.readCipherSuite = w.writeCipherSuite
+	typ, data, err := r.read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if typ != recordTypeHandshake || string(data) != "handshake data" {
+		t.Errorf("got (%d, %q), want (recordTypeHandshake, \"handshake data\")", typ, data)
+	}
+}
+
+func TestMockQUICTransportWireImageSkipEarlyDataResets(t *testing.T) {
+	conn := testConn{new(bytes.Buffer)}
+	w := newMockQUICTransport(conn, mockQUICTransportParams{wireImage: true})
+
+	w.writeLevel = encryptionEarlyData
+	if _, err := w.writeRecord(recordTypeApplicationData, []byte("0rtt")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+
+	w.writeLevel = encryptionHandshake
+	if _, err := w.writeRecord(recordTypeHandshake, []byte("hs")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+
+	// A second, later early-data datagram: once skipEarlyData has been
+	// cleared by the Handshake record above, this one should be rejected
+	// rather than silently skipped forever.
+	w.writeLevel = encryptionEarlyData
+	if _, err := w.writeRecord(recordTypeApplicationData, []byte("late 0rtt")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+	if err := w.releaseDatagrams(nil); err != nil {
+		t.Fatalf("releaseDatagrams: %v", err)
+	}
+
+	r := newMockQUICTransport(conn, mockQUICTransportParams{wireImage: true})
+	r.readLevel = encryptionHandshake
+	r.readCipherSuite = w.writeCipherSuite
+	r.skipEarlyData = true
+
+	typ, data, err := r.read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if typ != recordTypeHandshake || string(data) != "hs" {
+		t.Fatalf("got (%d, %q), want the Handshake record", typ, data)
+	}
+
+	if _, _, err := r.read(); err == nil {
+		t.Errorf("read of the later early-data datagram unexpectedly succeeded; skipEarlyData should have been cleared")
+	}
+}
+
+// TestMockQUICTransportEarlyDataMixedFlight writes a 0-RTT application data
+// record and a Handshake record into the same flight via writeRecordAtLevel,
+// without ever setting writeLevel/writeSecret to the early data ones,
+// mirroring a resumed client that emits early data before it has installed
+// Handshake write keys.
+func TestMockQUICTransportEarlyDataMixedFlight(t *testing.T) {
+	conn := testConn{new(bytes.Buffer)}
+	w := newMockQUICTransport(conn, mockQUICTransportParams{
+		wireImage:            true,
+		earlyDataCipherSuite: 0x1301,
+		earlyDataWriteSecret: []byte("early secret"),
+	})
+	w.writeLevel = encryptionHandshake
+	w.writeCipherSuite = 0x1301
+	w.writeSecret = []byte("handshake secret")
+
+	if _, err := w.writeRecordAtLevel(encryptionEarlyData, recordTypeApplicationData, []byte("0rtt request")); err != nil {
+		t.Fatalf("writeRecordAtLevel: %v", err)
+	}
+	if _, err := w.writeRecord(recordTypeHandshake, []byte("second flight")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if err := w.flushFlight(); err != nil {
+		t.Fatalf("flushFlight: %v", err)
+	}
+	if err := w.releaseDatagrams(nil); err != nil {
+		t.Fatalf("releaseDatagrams: %v", err)
+	}
+
+	r := newMockQUICTransport(conn, mockQUICTransportParams{
+		wireImage:             true,
+		allowOutOfOrderLevels: true,
+	})
+	r.readLevel = encryptionEarlyData
+	r.readCipherSuite = 0x1301
+	r.readSecret = []byte("early secret")
+
+	typ, data, err := r.read()
+	if err != nil {
+		t.Fatalf("read early data: %v", err)
+	}
+	if typ != recordTypeApplicationData || string(data) != "0rtt request" {
+		t.Errorf("got (%d, %q), want the early data record", typ, data)
+	}
+
+	r.readLevel = encryptionHandshake
+	r.readSecret = []byte("handshake secret")
+	typ, data, err = r.read()
+	if err != nil {
+		t.Fatalf("read handshake data: %v", err)
+	}
+	if typ != recordTypeHandshake || string(data) != "second flight" {
+		t.Errorf("got (%d, %q), want the Handshake record", typ, data)
+	}
+}
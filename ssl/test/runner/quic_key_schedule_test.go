@@ -0,0 +1,99 @@
+// Copyright (c) 2019, Google Inc.
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION
+// OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF OR IN
+// CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package runner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+)
+
+// TestQUICHKDFKnownAnswer checks quicHKDFExtract and quicDeriveSecret against
+// the SHA-256 Early Secret and its "derived" Derive-Secret output from RFC
+// 8448, Section 3's worked TLS 1.3 handshake trace. Both are computed from
+// fixed, all-zero inputs (no PSK, the hash of the empty string), independent
+// of any particular handshake transcript, so they are reusable known-answer
+// vectors: a transposition bug in the HKDF-Expand-Label length/label/context
+// encoding would change this output, even though it leaves
+// TestDeriveQUICKeyScheduleDeterministic and TestDeriveQUICKeyScheduleSHA384
+// unaffected.
+func TestQUICHKDFKnownAnswer(t *testing.T) {
+	zeros := make([]byte, sha256.Size)
+	earlySecret := quicHKDFExtract(sha256.New, zeros, zeros)
+	wantEarlySecret, err := hex.DecodeString("33ad0a1c607ec03b09e6cd9893680ce210adf300aa1f2660e1b22e10f170f92a")
+	if err != nil {
+		t.Fatalf("invalid test vector: %v", err)
+	}
+	if !bytes.Equal(earlySecret, wantEarlySecret) {
+		t.Errorf("Early Secret = %x, want %x (RFC 8448 known-answer)", earlySecret, wantEarlySecret)
+	}
+
+	derived := quicDeriveSecret(sha256.New, earlySecret, "derived", nil)
+	wantDerived, err := hex.DecodeString("6f2615a108c702c5678f54fc9dbab69716c076189c48250cebeac3576c3611ba")
+	if err != nil {
+		t.Fatalf("invalid test vector: %v", err)
+	}
+	if !bytes.Equal(derived, wantDerived) {
+		t.Errorf("derived secret = %x, want %x (RFC 8448 known-answer)", derived, wantDerived)
+	}
+}
+
+func TestTLS13HashForSuite(t *testing.T) {
+	if got := tls13HashForSuite(0x1302)().Size(); got != sha512.New384().Size() {
+		t.Errorf("got hash size %d for TLS_AES_256_GCM_SHA384, want SHA-384's %d", got, sha512.New384().Size())
+	}
+	for _, suite := range []uint16{0x1301, 0x1303, 0x0000} {
+		if got := tls13HashForSuite(suite)().Size(); got != sha256.New().Size() {
+			t.Errorf("got hash size %d for suite %#04x, want SHA-256's %d", got, suite, sha256.New().Size())
+		}
+	}
+}
+
+// TestDeriveQUICKeyScheduleSHA384 checks that deriving a key schedule for a
+// SHA-384 suite produces secrets of SHA-384's length, not SHA-256's; with the
+// key schedule hardcoded to SHA-256, this would either panic or silently
+// truncate.
+func TestDeriveQUICKeyScheduleSHA384(t *testing.T) {
+	sharedSecret := make([]byte, 32)
+	transcript := []byte("transcript")
+	schedule := deriveQUICKeySchedule(0x1302, sharedSecret, transcript, transcript)
+	wantLen := sha512.New384().Size()
+	for name, secret := range map[string][]byte{
+		"clientHandshakeTrafficSecret":    schedule.clientHandshakeTrafficSecret,
+		"serverHandshakeTrafficSecret":    schedule.serverHandshakeTrafficSecret,
+		"clientApplicationTrafficSecret0": schedule.clientApplicationTrafficSecret0,
+		"serverApplicationTrafficSecret0": schedule.serverApplicationTrafficSecret0,
+	} {
+		if len(secret) != wantLen {
+			t.Errorf("%s has length %d, want %d (SHA-384)", name, len(secret), wantLen)
+		}
+	}
+}
+
+func TestDeriveQUICKeyScheduleDeterministic(t *testing.T) {
+	sharedSecret := []byte("shared secret")
+	hello := []byte("hello transcript")
+	full := []byte("full transcript")
+	a := deriveQUICKeySchedule(0x1301, sharedSecret, hello, full)
+	b := deriveQUICKeySchedule(0x1301, sharedSecret, hello, full)
+	if string(a.clientHandshakeTrafficSecret) != string(b.clientHandshakeTrafficSecret) {
+		t.Errorf("deriveQUICKeySchedule is not deterministic")
+	}
+	if string(a.clientHandshakeTrafficSecret) == string(a.serverHandshakeTrafficSecret) {
+		t.Errorf("client and server handshake traffic secrets should differ")
+	}
+}
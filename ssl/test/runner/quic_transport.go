@@ -0,0 +1,167 @@
+// Copyright (c) 2019, Google Inc.
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION
+// OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF OR IN
+// CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package runner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// quicRecordTransport is the interface Conn uses to exchange TLS records over
+// QUIC. mockQUICTransport implements it over an in-process, unencrypted
+// stream for speed. quicTransport is a second implementation, over whatever
+// per-level quicCryptoStreams a caller supplies, intended for eventual interop
+// testing against a real QUIC stack (e.g. quic-go) over a UDP socket; no such
+// caller exists yet in this checkout, and nothing currently selects
+// quicTransport over mockQUICTransport.
+type quicRecordTransport interface {
+	net.Conn
+	readRecord(want recordType) (recordType, *block, error)
+	writeRecord(typ recordType, data []byte) (int, error)
+}
+
+var _ quicRecordTransport = (*mockQUICTransport)(nil)
+
+// quicCryptoStream is the reassembled, in-order byte stream of CRYPTO frame
+// payloads for a single encryptionLevel: Initial, 0-RTT, Handshake, or 1-RTT.
+// A real QUIC implementation's handshake driver, not this package, is
+// responsible for producing one of these per encryptionLevel and handing the
+// bytes a peer writes to it back out over the wire framed as CRYPTO frames.
+//
+// quicCryptoStream makes no promise that a single Read or Write carries
+// exactly one TLS record; like any io.Reader/io.Writer, a Read may return
+// less than a full record, and a Write may need to be split across multiple
+// underlying writes. quicTransport imposes its own record framing on top of
+// the stream, rather than assuming one record per call; see readRecord and
+// writeRecord.
+type quicCryptoStream interface {
+	io.Reader
+	io.Writer
+}
+
+// maxQUICCryptoRecord bounds the size of a single TLS record quicTransport
+// will read from or write to a quicCryptoStream.
+const maxQUICCryptoRecord = 1 << 16
+
+// quicTransport implements quicRecordTransport on top of per-level
+// cryptoStreams rather than mockQUICTransport's in-process, unencrypted,
+// explicitly length-prefixed byte stream. It does not itself talk to a QUIC
+// stack or a UDP socket; it only forwards TLS records to and from whatever
+// cryptoStreams it is constructed with, which is expected to be the
+// responsibility of a real QUIC implementation's handshake driver (e.g.
+// quic-go's) once one is wired in.
+//
+// quicTransport only handles recordTypeHandshake and
+// recordTypeApplicationData (for 0-RTT and post-handshake data); QUIC has no
+// equivalent of a TLS alert record; a CONNECTION_CLOSE frame is QUIC's
+// analogue, and translating alert writes into one is left to the QUIC stack
+// integration that supplies cryptoStreams, not this type.
+type quicTransport struct {
+	net.Conn
+	cryptoStreams         [encryptionApplication + 1]quicCryptoStream
+	readLevel, writeLevel encryptionLevel
+}
+
+// newQUICTransport returns a quicTransport that exchanges CRYPTO frame
+// payloads through cryptoStreams, one per encryptionLevel, as supplied by
+// driving a real QUIC stack's handshake hooks (e.g. quic-go's) over conn.
+func newQUICTransport(conn net.Conn, cryptoStreams [encryptionApplication + 1]quicCryptoStream) *quicTransport {
+	return &quicTransport{Conn: conn, cryptoStreams: cryptoStreams}
+}
+
+// quicRecordTypeForLevel returns the recordType a TLS record read or written
+// at level should be reported as: recordTypeApplicationData for the two
+// levels that carry 0-RTT and post-handshake application data, and
+// recordTypeHandshake for everything else.
+func quicRecordTypeForLevel(level encryptionLevel) recordType {
+	switch level {
+	case encryptionEarlyData, encryptionApplication:
+		return recordTypeApplicationData
+	default:
+		return recordTypeHandshake
+	}
+}
+
+func (q *quicTransport) readRecord(want recordType) (recordType, *block, error) {
+	stream := q.cryptoStreams[q.readLevel]
+	if stream == nil {
+		return 0, nil, fmt.Errorf("no crypto stream configured for level %d", q.readLevel)
+	}
+	data, err := readQUICCryptoRecord(stream)
+	if err != nil {
+		return 0, nil, err
+	}
+	return quicRecordTypeForLevel(q.readLevel), &block{data, 0, nil}, nil
+}
+
+func (q *quicTransport) writeRecord(typ recordType, data []byte) (int, error) {
+	if typ != recordTypeHandshake && typ != recordTypeApplicationData {
+		return 0, fmt.Errorf("unsupported record type %d over quicTransport\n", typ)
+	}
+	stream := q.cryptoStreams[q.writeLevel]
+	if stream == nil {
+		return 0, fmt.Errorf("no crypto stream configured for level %d", q.writeLevel)
+	}
+	if err := writeQUICCryptoRecord(stream, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// readQUICCryptoRecord reads one explicitly length-prefixed TLS record from
+// stream: a 4-byte big-endian length, followed by exactly that many bytes of
+// record payload. This framing is quicTransport's own; it exists because
+// quicCryptoStream gives no guarantee that a single Read returns a whole
+// record.
+func readQUICCryptoRecord(stream quicCryptoStream) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxQUICCryptoRecord {
+		return nil, fmt.Errorf("quic crypto record too large: %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(stream, data); err != nil {
+		return nil, fmt.Errorf("error reading quic crypto record: %s", err)
+	}
+	return data, nil
+}
+
+// writeQUICCryptoRecord writes data to stream with the framing
+// readQUICCryptoRecord expects.
+func writeQUICCryptoRecord(stream quicCryptoStream, data []byte) error {
+	if len(data) > maxQUICCryptoRecord {
+		return fmt.Errorf("quic crypto record too large: %d bytes", len(data))
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := stream.Write(header); err != nil {
+		return err
+	}
+	_, err := stream.Write(data)
+	return err
+}
+
+func (q *quicTransport) Write(b []byte) (int, error) {
+	panic("unexpected call to Write")
+}
+
+func (q *quicTransport) Read(b []byte) (int, error) {
+	panic("unexpected call to Read")
+}
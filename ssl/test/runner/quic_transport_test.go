@@ -0,0 +1,114 @@
+// Copyright (c) 2019, Google Inc.
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION
+// OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF OR IN
+// CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package runner
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chunkedStream is a quicCryptoStream backed by a bytes.Buffer whose Read
+// never returns more than chunkSize bytes at a time, regardless of how much
+// the caller asked for, to simulate a real CRYPTO-frame stream that hands
+// back partial messages.
+type chunkedStream struct {
+	buf       bytes.Buffer
+	chunkSize int
+}
+
+func (c *chunkedStream) Read(p []byte) (int, error) {
+	if len(p) > c.chunkSize {
+		p = p[:c.chunkSize]
+	}
+	return c.buf.Read(p)
+}
+
+func (c *chunkedStream) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func TestQUICCryptoRecordFramingSurvivesShortReads(t *testing.T) {
+	stream := &chunkedStream{chunkSize: 3}
+	want := []byte("a TLS handshake message long enough to span many 3-byte reads")
+	if err := writeQUICCryptoRecord(stream, want); err != nil {
+		t.Fatalf("writeQUICCryptoRecord: %v", err)
+	}
+
+	got, err := readQUICCryptoRecord(stream)
+	if err != nil {
+		t.Fatalf("readQUICCryptoRecord: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQUICCryptoRecordFramingMultipleRecords(t *testing.T) {
+	stream := &chunkedStream{chunkSize: 5}
+	records := [][]byte{[]byte("first record"), []byte("second, longer record"), []byte("3rd")}
+	for _, r := range records {
+		if err := writeQUICCryptoRecord(stream, r); err != nil {
+			t.Fatalf("writeQUICCryptoRecord: %v", err)
+		}
+	}
+	for _, want := range records {
+		got, err := readQUICCryptoRecord(stream)
+		if err != nil {
+			t.Fatalf("readQUICCryptoRecord: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestQUICRecordTypeForLevel(t *testing.T) {
+	tests := []struct {
+		level encryptionLevel
+		want  recordType
+	}{
+		{encryptionInitial, recordTypeHandshake},
+		{encryptionEarlyData, recordTypeApplicationData},
+		{encryptionHandshake, recordTypeHandshake},
+		{encryptionApplication, recordTypeApplicationData},
+	}
+	for _, tt := range tests {
+		if got := quicRecordTypeForLevel(tt.level); got != tt.want {
+			t.Errorf("quicRecordTypeForLevel(%d) = %d, want %d", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestQUICTransportReadRecordEarlyData(t *testing.T) {
+	var cryptoStreams [encryptionApplication + 1]quicCryptoStream
+	stream := &chunkedStream{chunkSize: 4}
+	cryptoStreams[encryptionEarlyData] = stream
+	q := newQUICTransport(nil, cryptoStreams)
+	q.readLevel = encryptionEarlyData
+
+	if err := writeQUICCryptoRecord(stream, []byte("0-RTT request")); err != nil {
+		t.Fatalf("writeQUICCryptoRecord: %v", err)
+	}
+	typ, block, err := q.readRecord(recordTypeApplicationData)
+	if err != nil {
+		t.Fatalf("readRecord: %v", err)
+	}
+	if typ != recordTypeApplicationData {
+		t.Errorf("got record type %d, want recordTypeApplicationData", typ)
+	}
+	if string(block.data) != "0-RTT request" {
+		t.Errorf("got data %q, want \"0-RTT request\"", block.data)
+	}
+}